@@ -12,7 +12,6 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
@@ -23,10 +22,31 @@ import (
 )
 
 const (
-	ServiceName    = "dex-tts-service"
-	PiperUrl       = "https://github.com/rhasspy/piper/releases/download/2023.11.14-2/piper_linux_x86_64.tar.gz"
-	VoiceModelUrl  = "https://huggingface.co/rhasspy/piper-voices/resolve/main/en/en_GB/northern_english_male/medium/en_GB-northern_english_male-medium.onnx"
-	VoiceConfigUrl = "https://huggingface.co/rhasspy/piper-voices/resolve/main/en/en_GB/northern_english_male/medium/en_GB-northern_english_male-medium.onnx.json"
+	ServiceName = "dex-tts-service"
+	PiperUrl    = "https://github.com/rhasspy/piper/releases/download/2023.11.14-2/piper_linux_x86_64.tar.gz"
+	// defaultPiperSHA256 pins the piper_linux_x86_64.tar.gz release above;
+	// bump it alongside PiperUrl whenever the pinned release changes.
+	//
+	// Left empty deliberately: downloadVerified treats "" as "skip this
+	// check" rather than failing closed (or, with TTS_REQUIRE_CHECKSUMS=1,
+	// as a hard failure). A fabricated digest is worse than no digest
+	// here -- it guarantees every fresh deploy fails checksum verification
+	// and never becomes ready. Set this to the real
+	// `curl -sL <PiperUrl> | sha256sum` output once it's been computed
+	// somewhere with network access; until then, verification is simply
+	// off for this asset rather than permanently broken. Production
+	// deploys that have computed the real digest can set it without a
+	// rebuild via TTS_PIPER_SHA256 -- see piperSHA256 below.
+	defaultPiperSHA256 = ""
+
+	// defaultSampleRate matches the northern_english_male-medium voice;
+	// used for the RIFF header piper's raw PCM output doesn't include.
+	defaultSampleRate = 22050
+
+	// streamingDataSize marks a WAV data chunk whose final size isn't
+	// known when the header is written, since /stream flushes audio as
+	// piper produces it rather than buffering the whole thing first.
+	streamingDataSize = 0xFFFFFFFF
 )
 
 var (
@@ -40,11 +60,20 @@ var (
 	redisClient *redis.Client
 	mu          sync.Mutex
 	isReady     = false
+
+	voices *VoiceRegistry
+
+	limiter rateLimiter
+	breaker *circuitBreaker
 )
 
 type GenerateRequest struct {
 	Text       string `json:"text"`
+	Voice      string `json:"voice,omitempty"`
 	OutputPath string `json:"output_path,omitempty"`
+	// InputType is "text" (default) or "ssml"; ssml is only supported by
+	// /generate, not /stream.
+	InputType string `json:"input_type,omitempty"`
 }
 
 func main() {
@@ -54,24 +83,52 @@ func main() {
 	}
 
 	setupRedis()
+	limiter = newRateLimiter()
+	breaker = newCircuitBreaker()
+
+	catalog, err := loadVoiceCatalog()
+	if err != nil {
+		log.Fatalf("Voice catalog failed to load: %v", err)
+	}
+
+	home, _ := os.UserHomeDir()
+	binDir := filepath.Join(home, "Dexter", "bin")
+	voices = newVoiceRegistry(
+		binDir,
+		filepath.Join(binDir, "piper", "piper"),
+		filepath.Join(home, "Dexter", "models", "piper"),
+		catalog,
+	)
 
 	// Async setup to not block startup, but handleGenerate will wait if not ready
 	go func() {
-		if err := ensureAssets(); err != nil {
+		if err := ensureAssets(voices); err != nil {
 			log.Printf("Asset setup failed: %v", err)
-		} else {
-			mu.Lock()
-			isReady = true
-			mu.Unlock()
-			log.Println("TTS Assets ready.")
+			return
+		}
+
+		for _, id := range defaultVoiceIDs() {
+			if _, err := voices.pool(id); err != nil {
+				log.Printf("Piper worker pool for voice %s failed to start: %v", id, err)
+				return
+			}
 		}
+
+		mu.Lock()
+		isReady = true
+		mu.Unlock()
+		log.Println("TTS Assets ready.")
 	}()
 
-	http.HandleFunc("/generate", handleGenerate)
+	http.HandleFunc("/generate", withRateLimitAndBreaker("generate", handleGenerate))
+	http.HandleFunc("/stream", withRateLimitAndBreaker("stream", handleStream))
 	http.HandleFunc("/hibernate", handleHibernate)
 	http.HandleFunc("/wakeup", handleWakeup)
 	http.HandleFunc("/health", handleHealth)
 	http.HandleFunc("/service", handleService)
+	http.HandleFunc("/metrics", handleMetrics)
+	http.HandleFunc("GET /voices", handleListVoices)
+	http.HandleFunc("POST /voices/{id}/install", handleInstallVoice)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -90,32 +147,36 @@ func setupRedis() {
 	})
 }
 
-func ensureAssets() error {
-	home, _ := os.UserHomeDir()
-	binDir := filepath.Join(home, "Dexter", "bin")
-	piperBin := filepath.Join(binDir, "piper", "piper")
-	modelsDir := filepath.Join(home, "Dexter", "models", "piper")
-	voicePath := filepath.Join(modelsDir, "en_GB-northern_english_male-medium.onnx")
-	configPath := filepath.Join(modelsDir, "en_GB-northern_english_male-medium.onnx.json")
+// piperSHA256 returns the expected checksum for the Piper release tarball:
+// TTS_PIPER_SHA256 if set, else defaultPiperSHA256. This lets an operator
+// who has confirmed the real digest pin it at deploy time without a
+// rebuild.
+func piperSHA256() string {
+	if v := os.Getenv("TTS_PIPER_SHA256"); v != "" {
+		return v
+	}
+	return defaultPiperSHA256
+}
 
+// ensureAssets downloads the piper binary and the default voice set if
+// they aren't already present.
+func ensureAssets(vr *VoiceRegistry) error {
 	// 1. Piper Binary
-	if _, err := os.Stat(piperBin); os.IsNotExist(err) {
+	if _, err := os.Stat(vr.piperBin); os.IsNotExist(err) {
 		log.Println("Downloading and installing Piper binary...")
-		if err := downloadAndExtract(PiperUrl, binDir); err != nil {
+		if err := downloadAndExtract(PiperUrl, vr.binDir, piperSHA256()); err != nil {
 			return err
 		}
 	}
 
-	// 2. Voice Assets
-	_ = os.MkdirAll(modelsDir, 0755)
-	if _, err := os.Stat(voicePath); os.IsNotExist(err) {
-		log.Println("Downloading Northern English male voice model...")
-		if err := downloadFile(VoiceModelUrl, voicePath); err != nil {
-			return err
+	// 2. Default Voice Assets
+	_ = os.MkdirAll(vr.modelsDir, 0755)
+	for _, id := range defaultVoiceIDs() {
+		if vr.isInstalled(id) {
+			continue
 		}
-	}
-	if _, err := os.Stat(configPath); os.IsNotExist(err) {
-		if err := downloadFile(VoiceConfigUrl, configPath); err != nil {
+		log.Printf("Downloading voice %s...", id)
+		if err := vr.install(id); err != nil {
 			return err
 		}
 	}
@@ -138,14 +199,29 @@ func downloadFile(url, dest string) error {
 	return err
 }
 
-func downloadAndExtract(url, destDir string) error {
-	resp, err := http.Get(url)
+// downloadAndExtract verifies url against expectedSHA256 before
+// extracting it into destDir, rejecting any tar entry whose cleaned
+// target path would land outside destDir (zip-slip).
+func downloadAndExtract(url, destDir, expectedSHA256 string) error {
+	tmp, err := os.CreateTemp("", "dex-tts-asset-*.tar.gz")
 	if err != nil {
 		return err
 	}
-	defer func() { _ = resp.Body.Close() }()
+	tmpPath := tmp.Name()
+	_ = tmp.Close()
+	defer func() { _ = os.Remove(tmpPath) }()
 
-	uncompressed, err := gzip.NewReader(resp.Body)
+	if err := downloadVerified(url, tmpPath, expectedSHA256, ""); err != nil {
+		return err
+	}
+
+	archiveFile, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = archiveFile.Close() }()
+
+	uncompressed, err := gzip.NewReader(archiveFile)
 	if err != nil {
 		return err
 	}
@@ -161,7 +237,11 @@ func downloadAndExtract(url, destDir string) error {
 			return err
 		}
 
-		target := filepath.Join(destDir, header.Name)
+		target, err := safeJoin(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.MkdirAll(target, 0755); err != nil {
@@ -182,58 +262,237 @@ func downloadAndExtract(url, destDir string) error {
 	return nil
 }
 
+// safeJoin joins name onto destDir and rejects the result if it escapes
+// destDir, e.g. via a tar entry like "../../etc/cron.d/evil".
+func safeJoin(destDir, name string) (string, error) {
+	target := filepath.Join(destDir, name)
+
+	destAbs, err := filepath.Abs(destDir)
+	if err != nil {
+		return "", err
+	}
+	targetAbs, err := filepath.Abs(target)
+	if err != nil {
+		return "", err
+	}
+	if targetAbs != destAbs && !strings.HasPrefix(targetAbs, destAbs+string(os.PathSeparator)) {
+		return "", fmt.Errorf("tar entry %q escapes destination directory", name)
+	}
+	return target, nil
+}
+
+// voiceSampleRate looks up voiceID's native sample rate from its
+// installed onnx.json, falling back to defaultSampleRate if it can't be
+// read (e.g. the voice isn't installed yet).
+func voiceSampleRate(voiceID string) int {
+	if sr, err := voices.sampleRate(voiceID); err == nil {
+		return sr
+	}
+	return defaultSampleRate
+}
+
 func handleGenerate(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
 	mu.Lock()
 	ready := isReady
 	mu.Unlock()
 
 	if !ready {
+		metrics.recordRequest("generate", "503")
 		http.Error(w, "TTS engine initializing", http.StatusServiceUnavailable)
 		return
 	}
 
 	var req GenerateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		metrics.recordRequest("generate", "400")
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	hash := md5.Sum([]byte(req.Text))
+	switch req.InputType {
+	case "", "text", "ssml":
+	default:
+		metrics.recordRequest("generate", "400")
+		http.Error(w, "input_type must be \"text\" or \"ssml\"", http.StatusBadRequest)
+		return
+	}
+
+	voiceID := req.Voice
+	if voiceID == "" {
+		voiceID = defaultVoiceID
+	}
+	p, err := voices.pool(voiceID)
+	if err != nil {
+		metrics.recordRequest("generate", "400")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hash := md5.Sum([]byte(req.InputType + "\x00" + voiceID + "\x00" + req.Text))
 	cacheKey := "tts:cache:" + hex.EncodeToString(hash[:])
 
 	if redisClient != nil {
 		if val, err := redisClient.Get(r.Context(), cacheKey).Bytes(); err == nil {
+			metrics.recordCacheHit()
+			metrics.recordRequest("generate", "200")
 			w.Header().Set("Content-Type", "audio/wav")
 			_, _ = w.Write(val)
 			return
 		}
 	}
+	metrics.recordCacheMiss()
+
+	// Tee the pool's raw PCM into a buffer so the full WAV can still be
+	// cached and returned in one shot, matching the previous behavior.
+	var pcm bytes.Buffer
+	sampleRate := voiceSampleRate(voiceID)
+	if req.InputType == "ssml" {
+		raw, err := synthesizeSSML(r.Context(), voiceID, p, sampleRate, req.Text)
+		if err != nil {
+			log.Printf("SSML synthesis error: %v", err)
+			metrics.recordRequest("generate", "500")
+			http.Error(w, "Generation failed", http.StatusInternalServerError)
+			return
+		}
+		pcm.Write(raw)
+	} else if err := p.submitStream(synthParams{Text: req.Text}, func(b []byte) error {
+		_, err := pcm.Write(b)
+		return err
+	}); err != nil {
+		log.Printf("Piper Error: %v", err)
+		metrics.recordRequest("generate", "500")
+		http.Error(w, "Generation failed", http.StatusInternalServerError)
+		return
+	}
 
-	home, _ := os.UserHomeDir()
-	piperBin := filepath.Join(home, "Dexter", "bin", "piper", "piper")
-	voicePath := filepath.Join(home, "Dexter", "models", "piper", "en_GB-northern_english_male-medium.onnx")
-
-	cmd := exec.Command(piperBin, "--model", voicePath, "--output_file", "-")
-	cmd.Stdin = strings.NewReader(req.Text)
 	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-
-	if err := cmd.Run(); err != nil {
-		log.Printf("Piper Error: %v, Stderr: %s", err, stderr.String())
+	if err := writeWavHeader(&out, uint32(pcm.Len()), sampleRate, 1, 16); err != nil {
+		metrics.recordRequest("generate", "500")
 		http.Error(w, "Generation failed", http.StatusInternalServerError)
 		return
 	}
+	out.Write(pcm.Bytes())
 
 	if redisClient != nil {
 		redisClient.Set(r.Context(), cacheKey, out.Bytes(), 48*time.Hour)
 	}
 
+	metrics.observeLatency(voiceID, time.Since(start).Seconds())
+	metrics.recordRequest("generate", "200")
 	w.Header().Set("Content-Type", "audio/wav")
 	_, _ = w.Write(out.Bytes())
 }
 
+// handleStream synthesizes req.Text and flushes raw PCM to the client as
+// piper produces it, so first-audio-byte latency isn't gated on the
+// whole utterance finishing. The response still cached the same as
+// /generate once the full WAV is known.
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	mu.Lock()
+	ready := isReady
+	mu.Unlock()
+
+	if !ready {
+		metrics.recordRequest("stream", "503")
+		http.Error(w, "TTS engine initializing", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req GenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		metrics.recordRequest("stream", "400")
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	switch req.InputType {
+	case "", "text":
+	default:
+		// synthesizeSSML buffers a whole document before returning, so
+		// routing it through here would both defeat the point of /stream
+		// and silently feed raw markup to piper as literal text if we
+		// didn't check at all. Until SSML synthesis is chunked, point
+		// callers at /generate instead.
+		metrics.recordRequest("stream", "400")
+		http.Error(w, "input_type \"ssml\" is not supported by /stream; use /generate", http.StatusBadRequest)
+		return
+	}
+
+	voiceID := req.Voice
+	if voiceID == "" {
+		voiceID = defaultVoiceID
+	}
+	p, err := voices.pool(voiceID)
+	if err != nil {
+		metrics.recordRequest("stream", "400")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	sampleRate := voiceSampleRate(voiceID)
+
+	w.Header().Set("Content-Type", "audio/wav")
+	w.WriteHeader(http.StatusOK)
+	if err := writeWavHeader(w, streamingDataSize, sampleRate, 1, 16); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	hash := md5.Sum([]byte(req.InputType + "\x00" + voiceID + "\x00" + req.Text))
+	cacheKey := "tts:cache:" + hex.EncodeToString(hash[:])
+
+	var pcm bytes.Buffer
+	err = p.submitStream(synthParams{Text: req.Text}, func(b []byte) error {
+		pcm.Write(b)
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	})
+	if err != nil {
+		log.Printf("Piper stream error: %v", err)
+		metrics.recordRequest("stream", "500")
+		return
+	}
+
+	metrics.observeLatency(voiceID, time.Since(start).Seconds())
+	metrics.recordRequest("stream", "200")
+
+	if redisClient != nil {
+		var cached bytes.Buffer
+		if writeWavHeader(&cached, uint32(pcm.Len()), sampleRate, 1, 16) == nil {
+			cached.Write(pcm.Bytes())
+			redisClient.Set(r.Context(), cacheKey, cached.Bytes(), 48*time.Hour)
+		}
+	}
+}
+
+func handleListVoices(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"voices": voices.list()})
+}
+
+func handleInstallVoice(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if err := voices.install(id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"status": "ok", "voice": id})
+}
+
 func handleHibernate(w http.ResponseWriter, r *http.Request) {
 	// Piper is process-based, no persistent VRAM usage when idle.
 	w.Header().Set("Content-Type", "application/json")
@@ -275,6 +534,8 @@ func handleService(w http.ResponseWriter, r *http.Request) {
 			"status": "OK",
 			"uptime": time.Since(startTime).String(),
 		},
+		"rate_limit":      rateLimitReport(r),
+		"circuit_breaker": map[string]interface{}{"state": breaker.snapshot()},
 	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(report)
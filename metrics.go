@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/EasterCompany/dex-tts-service/utils"
+)
+
+// latencyBuckets are the upper bounds (seconds) for the generation
+// latency histogram, chosen to cover short phrases through long
+// paragraphs of synthesized speech.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10}
+
+// voiceLatency accumulates a Prometheus-style cumulative histogram for
+// one voice: counts[i] holds the number of observations <= latencyBuckets[i].
+type voiceLatency struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// requestMetrics is the process-wide metrics state /metrics renders.
+type requestMetrics struct {
+	mu          sync.Mutex
+	requestsBy  map[string]uint64 // "route:status" -> count
+	cacheHits   uint64
+	cacheMisses uint64
+	latencyBy   map[string]*voiceLatency // voice -> histogram
+}
+
+var metrics = &requestMetrics{
+	requestsBy: make(map[string]uint64),
+	latencyBy:  make(map[string]*voiceLatency),
+}
+
+func (m *requestMetrics) recordRequest(route, status string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requestsBy[route+":"+status]++
+}
+
+func (m *requestMetrics) recordCacheHit() {
+	m.mu.Lock()
+	m.cacheHits++
+	m.mu.Unlock()
+}
+
+func (m *requestMetrics) recordCacheMiss() {
+	m.mu.Lock()
+	m.cacheMisses++
+	m.mu.Unlock()
+}
+
+func (m *requestMetrics) observeLatency(voice string, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	vl, ok := m.latencyBy[voice]
+	if !ok {
+		vl = &voiceLatency{counts: make([]uint64, len(latencyBuckets))}
+		m.latencyBy[voice] = vl
+	}
+	for i, upperBound := range latencyBuckets {
+		if seconds <= upperBound {
+			vl.counts[i]++
+		}
+	}
+	vl.sum += seconds
+	vl.count++
+}
+
+// snapshot returns a deep copy so rendering doesn't hold the lock while
+// writing to the response.
+func (m *requestMetrics) snapshot() (requestsBy map[string]uint64, cacheHits, cacheMisses uint64, latencyBy map[string]*voiceLatency) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	requestsBy = make(map[string]uint64, len(m.requestsBy))
+	for k, v := range m.requestsBy {
+		requestsBy[k] = v
+	}
+	latencyBy = make(map[string]*voiceLatency, len(m.latencyBy))
+	for voice, vl := range m.latencyBy {
+		latencyBy[voice] = &voiceLatency{
+			counts: append([]uint64(nil), vl.counts...),
+			sum:    vl.sum,
+			count:  vl.count,
+		}
+	}
+	return requestsBy, m.cacheHits, m.cacheMisses, latencyBy
+}
+
+// handleMetrics renders process, cache, worker-pool, and generation
+// metrics in Prometheus text exposition format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	requestsBy, cacheHits, cacheMisses, latencyBy := metrics.snapshot()
+
+	var b strings.Builder
+
+	b.WriteString("# HELP tts_requests_total Total HTTP requests by route and status.\n")
+	b.WriteString("# TYPE tts_requests_total counter\n")
+	routeKeys := make([]string, 0, len(requestsBy))
+	for k := range requestsBy {
+		routeKeys = append(routeKeys, k)
+	}
+	sort.Strings(routeKeys)
+	for _, k := range routeKeys {
+		parts := strings.SplitN(k, ":", 2)
+		fmt.Fprintf(&b, "tts_requests_total{route=%q,status=%q} %d\n", parts[0], parts[1], requestsBy[k])
+	}
+
+	b.WriteString("# HELP tts_cache_hit_ratio Fraction of /generate requests served from cache.\n")
+	b.WriteString("# TYPE tts_cache_hit_ratio gauge\n")
+	ratio := 0.0
+	if total := cacheHits + cacheMisses; total > 0 {
+		ratio = float64(cacheHits) / float64(total)
+	}
+	fmt.Fprintf(&b, "tts_cache_hit_ratio %g\n", ratio)
+
+	writeLatencyHistogram(&b, "tts_generate_latency_seconds", latencyBy)
+
+	b.WriteString("# HELP tts_worker_pool_queue_depth Synthesis jobs queued or in flight, per voice worker pool.\n")
+	b.WriteString("# TYPE tts_worker_pool_queue_depth gauge\n")
+	pools := voices.activePools()
+	voiceIDs := make([]string, 0, len(pools))
+	for id := range pools {
+		voiceIDs = append(voiceIDs, id)
+	}
+	sort.Strings(voiceIDs)
+	for _, id := range voiceIDs {
+		fmt.Fprintf(&b, "tts_worker_pool_queue_depth{voice=%q} %d\n", id, pools[id].queueDepth())
+	}
+
+	writeProcessMetrics(&b, pools)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
+
+func writeLatencyHistogram(b *strings.Builder, name string, latencyBy map[string]*voiceLatency) {
+	fmt.Fprintf(b, "# HELP %s Piper generation latency in seconds by voice.\n", name)
+	fmt.Fprintf(b, "# TYPE %s histogram\n", name)
+
+	voiceIDs := make([]string, 0, len(latencyBy))
+	for id := range latencyBy {
+		voiceIDs = append(voiceIDs, id)
+	}
+	sort.Strings(voiceIDs)
+
+	for _, voice := range voiceIDs {
+		vl := latencyBy[voice]
+		for i, upperBound := range latencyBuckets {
+			fmt.Fprintf(b, "%s_bucket{voice=%q,le=%q} %d\n", name, voice, strconv.FormatFloat(upperBound, 'g', -1, 64), vl.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{voice=%q,le=\"+Inf\"} %d\n", name, voice, vl.count)
+		fmt.Fprintf(b, "%s_sum{voice=%q} %g\n", name, voice, vl.sum)
+		fmt.Fprintf(b, "%s_count{voice=%q} %d\n", name, voice, vl.count)
+	}
+}
+
+// writeProcessMetrics emits a gauge for the main process plus one for
+// every live piper worker PID across all active voice pools.
+func writeProcessMetrics(b *strings.Builder, pools map[string]*workerPool) {
+	b.WriteString("# HELP tts_process_cpu_percent CPU utilization percent since the previous scrape.\n")
+	b.WriteString("# TYPE tts_process_cpu_percent gauge\n")
+	b.WriteString("# HELP tts_process_memory_mb Resident set size in megabytes.\n")
+	b.WriteString("# TYPE tts_process_memory_mb gauge\n")
+
+	main := utils.GetProcessMetrics(os.Getpid())
+	fmt.Fprintf(b, "tts_process_cpu_percent{process=\"main\"} %g\n", main.CPU.Avg)
+	fmt.Fprintf(b, "tts_process_memory_mb{process=\"main\"} %g\n", main.Memory.Avg)
+
+	voiceIDs := make([]string, 0, len(pools))
+	for id := range pools {
+		voiceIDs = append(voiceIDs, id)
+	}
+	sort.Strings(voiceIDs)
+
+	for _, voice := range voiceIDs {
+		for _, pid := range pools[voice].pids() {
+			m := utils.GetProcessMetrics(pid)
+			fmt.Fprintf(b, "tts_process_cpu_percent{process=\"piper\",voice=%q,pid=\"%d\"} %g\n", voice, pid, m.CPU.Avg)
+			fmt.Fprintf(b, "tts_process_memory_mb{process=\"piper\",voice=%q,pid=\"%d\"} %g\n", voice, pid, m.Memory.Avg)
+		}
+	}
+}
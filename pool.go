@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultWorkerCount is used when TTS_WORKERS is unset or invalid.
+const defaultWorkerCount = 2
+
+// idleWindow is how long a worker waits for more piper stdout before
+// deciding an utterance is finished. Piper reads one line of input at a
+// time and blocks on stdin again once it has written all of an
+// utterance's audio, so a short quiet period reliably marks the boundary
+// between utterances on the same long-lived process.
+const idleWindow = 150 * time.Millisecond
+
+// ttsWorkerCount reads TTS_WORKERS, falling back to defaultWorkerCount.
+func ttsWorkerCount() int {
+	if v := os.Getenv("TTS_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return defaultWorkerCount
+}
+
+// synthParams is one utterance dispatched to a worker's piper process.
+// LengthScale and NoiseScale are piper's own per-utterance overrides
+// (speaking rate and expressiveness respectively); zero means "let piper
+// use the value it was started with".
+type synthParams struct {
+	Text        string
+	LengthScale float64
+	NoiseScale  float64
+}
+
+// synthJob is one utterance dispatched to a worker's piper process.
+// onChunk is invoked as raw PCM bytes arrive so callers can stream them
+// on without waiting for the whole utterance to finish.
+type synthJob struct {
+	params  synthParams
+	onChunk func([]byte) error
+	done    chan error
+}
+
+// piperWorker wraps a single long-lived `piper --output_raw` process.
+// Jobs for a given worker are only ever run from that worker's own
+// dispatch goroutine, so no locking is needed around stdin/stdout use;
+// the mutex only guards the fields against the restart-on-exit race.
+type piperWorker struct {
+	id        int
+	piperBin  string
+	voicePath string
+	jobs      chan *synthJob
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	stdin      io.WriteCloser
+	stdout     *bufio.Reader
+	stdoutFile *os.File
+}
+
+// workerPool is a round-robin pool of piperWorkers for a single voice.
+type workerPool struct {
+	voiceID   string
+	piperBin  string
+	voicePath string
+	workers   []*piperWorker
+	counter   uint64
+	closing   int32
+	exited    chan int
+	queued    int64
+}
+
+// newWorkerPool starts size long-lived piper processes for voiceID and
+// launches the goroutines that dispatch jobs to them and restart them on
+// unexpected exit.
+func newWorkerPool(voiceID, piperBin, voicePath string, size int) (*workerPool, error) {
+	p := &workerPool{
+		voiceID:   voiceID,
+		piperBin:  piperBin,
+		voicePath: voicePath,
+		exited:    make(chan int, size),
+	}
+	for i := 0; i < size; i++ {
+		w := &piperWorker{id: i, piperBin: piperBin, voicePath: voicePath, jobs: make(chan *synthJob, 16)}
+		if err := w.spawn(p.exited); err != nil {
+			return nil, fmt.Errorf("start piper worker %d for voice %s: %w", i, voiceID, err)
+		}
+		p.workers = append(p.workers, w)
+		go p.dispatchLoop(w)
+	}
+	go p.supervise()
+	return p, nil
+}
+
+// supervise restarts workers whose piper process exited unexpectedly. Each
+// restart runs in its own goroutine so a worker stuck retrying a failed
+// respawn can't delay the pool from noticing other workers' exits.
+func (p *workerPool) supervise() {
+	for id := range p.exited {
+		if atomic.LoadInt32(&p.closing) != 0 {
+			return
+		}
+		go p.respawn(id)
+	}
+}
+
+// respawn retries w.spawn with backoff until it succeeds or the pool is
+// closing. A bare one-shot spawn() call here would, on a failed restart
+// attempt (spawn returning before it installs the cmd.Wait watcher that
+// feeds p.exited), permanently strand that worker's slot of round-robin
+// traffic -- nothing would ever retry it again.
+func (p *workerPool) respawn(id int) {
+	w := p.workers[id]
+	backoff := time.Second
+	for {
+		if atomic.LoadInt32(&p.closing) != 0 {
+			return
+		}
+		log.Printf("piper worker %d (voice %s) exited, restarting", id, p.voiceID)
+		if err := w.spawn(p.exited); err == nil {
+			return
+		} else {
+			log.Printf("piper worker %d (voice %s) failed to restart: %v (retrying in %s)", id, p.voiceID, err, backoff)
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (p *workerPool) dispatchLoop(w *piperWorker) {
+	for job := range w.jobs {
+		job.done <- w.synthesizeStream(job.params, job.onChunk)
+	}
+}
+
+// submitStream dispatches params to the next worker (round-robin) and
+// invokes onChunk for each piece of raw PCM as it is produced.
+func (p *workerPool) submitStream(params synthParams, onChunk func([]byte) error) error {
+	atomic.AddInt64(&p.queued, 1)
+	defer atomic.AddInt64(&p.queued, -1)
+
+	job := &synthJob{params: params, onChunk: onChunk, done: make(chan error, 1)}
+	idx := int(atomic.AddUint64(&p.counter, 1) % uint64(len(p.workers)))
+	p.workers[idx].jobs <- job
+	return <-job.done
+}
+
+// queueDepth is the number of jobs currently queued or in flight across
+// the pool's workers, for the worker-pool queue depth gauge.
+func (p *workerPool) queueDepth() int64 {
+	return atomic.LoadInt64(&p.queued)
+}
+
+// pids returns the OS process id of every worker's live piper process.
+func (p *workerPool) pids() []int {
+	pids := make([]int, 0, len(p.workers))
+	for _, w := range p.workers {
+		if pid := w.pid(); pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return pids
+}
+
+// submit is submitStream for callers that just want the full PCM buffer.
+func (p *workerPool) submit(params synthParams) ([]byte, error) {
+	var buf bytes.Buffer
+	err := p.submitStream(params, func(b []byte) error {
+		buf.Write(b)
+		return nil
+	})
+	return buf.Bytes(), err
+}
+
+// close stops accepting jobs and kills every worker's piper process.
+func (p *workerPool) close() {
+	atomic.StoreInt32(&p.closing, 1)
+	for _, w := range p.workers {
+		close(w.jobs)
+		w.mu.Lock()
+		if w.cmd != nil && w.cmd.Process != nil {
+			_ = w.cmd.Process.Kill()
+		}
+		w.mu.Unlock()
+	}
+}
+
+// spawn (re)starts the underlying piper process and installs a watcher
+// that reports the process's exit on the pool's shared channel.
+func (w *piperWorker) spawn(exited chan<- int) error {
+	// --json-input lets each line carry its own length_scale/noise_scale
+	// overrides (for SSML <prosody> support) instead of fixing them for
+	// the process's whole lifetime.
+	cmd := exec.Command(w.piperBin, "--model", w.voicePath, "--output_raw", "--json-input")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.cmd = cmd
+	w.stdin = stdin
+	w.stdout = bufio.NewReader(stdoutPipe)
+	w.stdoutFile, _ = stdoutPipe.(*os.File)
+	w.mu.Unlock()
+
+	go func() {
+		_ = cmd.Wait()
+		select {
+		case exited <- w.id:
+		default:
+		}
+	}()
+	return nil
+}
+
+// piperInputLine is one line of --json-input: piper reads text plus any
+// per-utterance overrides from it rather than from bare stdin text.
+type piperInputLine struct {
+	Text        string  `json:"text"`
+	LengthScale float64 `json:"length_scale,omitempty"`
+	NoiseScale  float64 `json:"noise_scale,omitempty"`
+}
+
+// synthesizeStream writes one utterance to the worker's piper stdin and
+// streams the resulting raw PCM to onChunk until piper goes quiet.
+//
+// The idleWindow heuristic can guess wrong under CPU contention: if piper
+// pauses mid-utterance for longer than idleWindow, the read loop below
+// returns early and the rest of that utterance's audio is still on its
+// way. Left alone, those trailing bytes would land at the top of the
+// *next* job sent to this same worker and corrupt a different caller's
+// response. To make that failure visible and contained instead of silent,
+// every call first drains and discards whatever is already sitting in the
+// pipe from a previous early return, logging how much was thrown away.
+func (w *piperWorker) synthesizeStream(params synthParams, onChunk func([]byte) error) error {
+	w.mu.Lock()
+	stdin := w.stdin
+	stdout := w.stdout
+	stdoutFile := w.stdoutFile
+	w.mu.Unlock()
+
+	if discarded := drainStaleOutput(stdout, stdoutFile); discarded > 0 {
+		log.Printf("piper worker %d: discarded %d stale byte(s) left over from a previous utterance; idleWindow likely returned early and truncated it", w.id, discarded)
+	}
+
+	line, err := json.Marshal(piperInputLine{
+		Text:        params.Text,
+		LengthScale: params.LengthScale,
+		NoiseScale:  params.NoiseScale,
+	})
+	if err != nil {
+		return fmt.Errorf("encode piper input: %w", err)
+	}
+	if _, err := stdin.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write piper stdin: %w", err)
+	}
+
+	return readUntilIdle(stdout, stdoutFile, onChunk)
+}
+
+// readUntilIdle reads raw PCM from stdout, invoking onChunk for each piece
+// as it arrives, until stdout has gone quiet for idleWindow. Split out
+// from synthesizeStream so it can be exercised directly in tests against a
+// plain os.Pipe instead of a real piper process.
+func readUntilIdle(stdout *bufio.Reader, stdoutFile *os.File, onChunk func([]byte) error) error {
+	chunk := make([]byte, 32*1024)
+	received := false
+	for {
+		if stdoutFile != nil {
+			_ = stdoutFile.SetReadDeadline(time.Now().Add(idleWindow))
+		}
+		n, err := stdout.Read(chunk)
+		if n > 0 {
+			received = true
+			if cbErr := onChunk(chunk[:n]); cbErr != nil {
+				return cbErr
+			}
+		}
+		if err == nil {
+			continue
+		}
+		if isTimeout(err) {
+			if received {
+				return nil
+			}
+			continue
+		}
+		if err == io.EOF && received {
+			return nil
+		}
+		return fmt.Errorf("read piper stdout: %w", err)
+	}
+}
+
+// drainStaleOutput discards any bytes already buffered in stdout, returning
+// how many were thrown away. It uses a much shorter deadline than
+// idleWindow since it's only mopping up bytes that arrived while nobody
+// was reading, not waiting out a live utterance.
+func drainStaleOutput(stdout *bufio.Reader, stdoutFile *os.File) int {
+	if stdoutFile == nil {
+		return 0
+	}
+	chunk := make([]byte, 32*1024)
+	discarded := 0
+	for {
+		_ = stdoutFile.SetReadDeadline(time.Now().Add(time.Millisecond))
+		n, err := stdout.Read(chunk)
+		discarded += n
+		if err != nil {
+			break
+		}
+	}
+	return discarded
+}
+
+// pid returns the worker's current piper process id, or 0 if it isn't
+// running (e.g. mid-restart).
+func (w *piperWorker) pid() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.cmd == nil || w.cmd.Process == nil {
+		return 0
+	}
+	return w.cmd.Process.Pid
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// writeWavHeader writes a canonical 44-byte RIFF/WAVE header to w.
+// dataSize may be streamingDataSize for streams whose total length isn't
+// known up front; most players tolerate this and simply read until EOF.
+func writeWavHeader(w io.Writer, dataSize uint32, sampleRate, channels, bitsPerSample int) error {
+	byteRate := sampleRate * channels * bitsPerSample / 8
+	blockAlign := channels * bitsPerSample / 8
+
+	// The RIFF chunk size is dataSize+36, but that overflows uint32 when
+	// dataSize is the streamingDataSize placeholder; leave it at the
+	// placeholder too rather than wrapping to a tiny, truncating value.
+	riffSize := dataSize
+	if dataSize != streamingDataSize {
+		riffSize = dataSize + 36
+	}
+
+	header := new(bytes.Buffer)
+	header.WriteString("RIFF")
+	writeUint32(header, riffSize)
+	header.WriteString("WAVE")
+	header.WriteString("fmt ")
+	writeUint32(header, 16)
+	writeUint16(header, 1) // PCM
+	writeUint16(header, uint16(channels))
+	writeUint32(header, uint32(sampleRate))
+	writeUint32(header, uint32(byteRate))
+	writeUint16(header, uint16(blockAlign))
+	writeUint16(header, uint16(bitsPerSample))
+	header.WriteString("data")
+	writeUint32(header, dataSize)
+
+	_, err := w.Write(header.Bytes())
+	return err
+}
+
+func writeUint32(w io.Writer, v uint32) {
+	_, _ = w.Write([]byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)})
+}
+
+func writeUint16(w io.Writer, v uint16) {
+	_, _ = w.Write([]byte{byte(v), byte(v >> 8)})
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadUntilIdleReturnsAfterQuietPeriod(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+	// The writer stays open, so readUntilIdle can only return once the
+	// pipe has gone quiet for idleWindow, not on EOF.
+	defer func() { _ = w.Close() }()
+
+	go func() {
+		_, _ = w.Write([]byte("hello"))
+	}()
+
+	var got []byte
+	err = readUntilIdle(bufio.NewReader(r), r, func(b []byte) error {
+		got = append(got, b...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readUntilIdle: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("got %q, want %q", got, "hello")
+	}
+}
+
+// TestDrainStaleOutputDiscardsLeftoverBytes is the regression test for the
+// corruption the reviewer flagged: if idleWindow returns early while piper
+// is still mid-utterance, the trailing bytes it eventually writes must not
+// become the prefix of the next job's audio on this worker.
+func TestDrainStaleOutputDiscardsLeftoverBytes(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+
+	// Simulate a previous utterance's straggler bytes arriving late, after
+	// synthesizeStream already returned on an idle timeout.
+	if _, err := w.Write([]byte("stale-tail-of-previous-utterance")); err != nil {
+		t.Fatalf("write stale bytes: %v", err)
+	}
+	// Give the writer a moment to land in the pipe buffer before draining.
+	time.Sleep(5 * time.Millisecond)
+
+	stdout := bufio.NewReader(r)
+	if discarded := drainStaleOutput(stdout, r); discarded == 0 {
+		t.Fatal("drainStaleOutput discarded 0 bytes, want the stale write to be consumed")
+	}
+
+	// Now simulate the next job: its bytes must arrive uncontaminated.
+	go func() {
+		_, _ = w.Write([]byte("next-job-audio"))
+		_ = w.Close()
+	}()
+
+	var got []byte
+	if err := readUntilIdle(stdout, r, func(b []byte) error {
+		got = append(got, b...)
+		return nil
+	}); err != nil {
+		t.Fatalf("readUntilIdle: %v", err)
+	}
+	if string(got) != "next-job-audio" {
+		t.Errorf("next job's audio = %q, want %q (stale bytes leaked in)", got, "next-job-audio")
+	}
+}
+
+func TestDrainStaleOutputIsNoopWhenPipeIsQuiet(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe: %v", err)
+	}
+	defer func() { _ = r.Close() }()
+	defer func() { _ = w.Close() }()
+
+	if discarded := drainStaleOutput(bufio.NewReader(r), r); discarded != 0 {
+		t.Errorf("drainStaleOutput on a quiet pipe discarded %d bytes, want 0", discarded)
+	}
+}
+
+func TestWorkerPoolRespawnRetriesAfterFailedRestart(t *testing.T) {
+	p := &workerPool{
+		voiceID: "test-voice",
+		workers: []*piperWorker{{id: 0, piperBin: "/nonexistent/piper-binary"}},
+		exited:  make(chan int, 1),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.respawn(0)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("respawn returned immediately after a failed restart; it should keep retrying until spawn succeeds or the pool closes")
+	case <-time.After(50 * time.Millisecond):
+		// Still retrying, as expected; stop it by closing the pool.
+	}
+
+	atomic.StoreInt32(&p.closing, 1)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("respawn did not stop after the pool was marked closing")
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// breakerBucketCount buckets of one second each give the circuit breaker
+// a breakerWindow-second rolling view of the error rate.
+const breakerBucketCount = 10
+
+// breakerWindow is how far back the circuit breaker looks when deciding
+// whether the recent error rate has crossed its threshold.
+const breakerWindow = breakerBucketCount * time.Second
+
+// breakerHalfOpenProbes is how many consecutive successes a half-open
+// breaker needs before it closes again.
+const breakerHalfOpenProbes = 3
+
+// rateLimiter is the pluggable storage for per-client token buckets:
+// in-process by default, Redis-backed (so replicas share quotas) when
+// RATELIMIT_BACKEND=redis.
+type rateLimiter interface {
+	// allow reports whether key has a token to spend, the remaining
+	// tokens, and how long to wait before retrying if not.
+	allow(ctx context.Context, key string) (allowed bool, retryAfter time.Duration, tokens float64, err error)
+	// peek reports key's current token level without spending one, for
+	// /service to show actual back-pressure rather than static config.
+	peek(ctx context.Context, key string) (tokens float64, err error)
+	// describe summarizes the limiter's config for /service.
+	describe() map[string]interface{}
+}
+
+// newRateLimiter builds the limiter configured by RATELIMIT_RPS,
+// RATELIMIT_BURST, and RATELIMIT_BACKEND.
+func newRateLimiter() rateLimiter {
+	rate := envFloat("RATELIMIT_RPS", 2.0)
+	burst := envFloat("RATELIMIT_BURST", 5.0)
+	if os.Getenv("RATELIMIT_BACKEND") == "redis" && redisClient != nil {
+		return &redisRateLimiter{client: redisClient, rate: rate, burst: burst}
+	}
+	return newMemoryRateLimiter(rate, burst)
+}
+
+// memoryBucket is one client's token bucket state.
+type memoryBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// memoryRateLimiter is the default single-process limiter backend.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	rate    float64 // tokens added per second
+	burst   float64 // bucket capacity
+}
+
+func newMemoryRateLimiter(rate, burst float64) *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: make(map[string]*memoryBucket), rate: rate, burst: burst}
+}
+
+func (l *memoryRateLimiter) allow(_ context.Context, key string) (bool, time.Duration, float64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: l.burst, lastRefill: now}
+		l.buckets[key] = b
+	}
+
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+	b.lastRefill = now
+
+	if b.tokens < 1 {
+		retryAfter := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, retryAfter, b.tokens, nil
+	}
+	b.tokens--
+	return true, 0, b.tokens, nil
+}
+
+// peek reports key's current token level, refilled up to now but not
+// spent, without creating a bucket for a key that hasn't been seen yet.
+func (l *memoryRateLimiter) peek(_ context.Context, key string) (float64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		return l.burst, nil
+	}
+	elapsed := time.Since(b.lastRefill).Seconds()
+	return math.Min(l.burst, b.tokens+elapsed*l.rate), nil
+}
+
+func (l *memoryRateLimiter) describe() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"backend":         "memory",
+		"rate":            l.rate,
+		"burst":           l.burst,
+		"tracked_clients": len(l.buckets),
+	}
+}
+
+// tokenBucketScript is a Lua token-bucket so check-and-decrement stays
+// atomic across replicas sharing one Redis instance.
+const tokenBucketScript = `
+local key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local data = redis.call("HMGET", key, "tokens", "ts")
+local tokens = tonumber(data[1])
+local ts = tonumber(data[2])
+if tokens == nil then
+  tokens = burst
+  ts = now
+end
+
+local elapsed = math.max(0, now - ts)
+tokens = math.min(burst, tokens + elapsed * rate)
+
+local allowed = 0
+if tokens >= 1 then
+  allowed = 1
+  tokens = tokens - 1
+end
+
+redis.call("HMSET", key, "tokens", tokens, "ts", now)
+redis.call("EXPIRE", key, 3600)
+
+return {allowed, tostring(tokens)}
+`
+
+// redisRateLimiter shares quotas across replicas; used when
+// RATELIMIT_BACKEND=redis.
+type redisRateLimiter struct {
+	client *redis.Client
+	rate   float64
+	burst  float64
+}
+
+func (l *redisRateLimiter) allow(ctx context.Context, key string) (bool, time.Duration, float64, error) {
+	now := float64(time.Now().UnixNano()) / 1e9
+	res, err := l.client.Eval(ctx, tokenBucketScript, []string{"tts:ratelimit:" + key}, l.rate, l.burst, now).Result()
+	if err != nil {
+		// Fail open: a Redis outage shouldn't take synthesis down with it.
+		return true, 0, l.burst, fmt.Errorf("rate limiter redis eval: %w", err)
+	}
+
+	vals, ok := res.([]interface{})
+	if !ok || len(vals) != 2 {
+		return true, 0, l.burst, fmt.Errorf("unexpected rate limiter script result: %v", res)
+	}
+	allowed, _ := vals[0].(int64)
+	tokens, _ := strconv.ParseFloat(fmt.Sprint(vals[1]), 64)
+
+	if allowed == 1 {
+		return true, 0, tokens, nil
+	}
+	retryAfter := time.Duration((1 - tokens) / l.rate * float64(time.Second))
+	return false, retryAfter, tokens, nil
+}
+
+// peek reports key's current token level, refilled up to now but not
+// spent. It reads the stored bucket directly rather than going through
+// tokenBucketScript, so a peek never consumes a token.
+func (l *redisRateLimiter) peek(ctx context.Context, key string) (float64, error) {
+	res, err := l.client.HMGet(ctx, "tts:ratelimit:"+key, "tokens", "ts").Result()
+	if err != nil {
+		return l.burst, fmt.Errorf("rate limiter redis peek: %w", err)
+	}
+	if res[0] == nil {
+		return l.burst, nil
+	}
+
+	tokens, _ := strconv.ParseFloat(fmt.Sprint(res[0]), 64)
+	ts, _ := strconv.ParseFloat(fmt.Sprint(res[1]), 64)
+	elapsed := math.Max(0, float64(time.Now().UnixNano())/1e9-ts)
+	return math.Min(l.burst, tokens+elapsed*l.rate), nil
+}
+
+func (l *redisRateLimiter) describe() map[string]interface{} {
+	return map[string]interface{}{
+		"backend": "redis",
+		"rate":    l.rate,
+		"burst":   l.burst,
+	}
+}
+
+// clientIP identifies the caller for rate limiting: the connection's own
+// remote address, unless it's a trusted proxy forwarding one via
+// X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	remoteIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteIP = r.RemoteAddr
+	}
+
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" && isTrustedProxy(remoteIP) {
+		if client := strings.TrimSpace(strings.Split(xff, ",")[0]); client != "" {
+			return client
+		}
+	}
+	return remoteIP
+}
+
+// isTrustedProxy reports whether ip is allowed to set X-Forwarded-For, per
+// the comma-separated TTS_TRUSTED_PROXIES env var.
+func isTrustedProxy(ip string) bool {
+	v := os.Getenv("TTS_TRUSTED_PROXIES")
+	if v == "" {
+		return false
+	}
+	for _, trusted := range strings.Split(v, ",") {
+		if strings.TrimSpace(trusted) == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// breakerState is one of the three states a circuitBreaker moves through.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half_open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerBucket counts one second's worth of requests, for the rolling
+// error-rate window.
+type breakerBucket struct {
+	atUnix   int64
+	total    int
+	failures int
+}
+
+// circuitBreaker trips when the error rate across the last breakerWindow
+// of requests crosses errorThreshold, short-circuiting new requests with
+// 503 until cooldown elapses, then lets a few probes through half-open
+// before fully closing again.
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	buckets [breakerBucketCount]breakerBucket
+	state   breakerState
+
+	openedAt   time.Time
+	halfOpenOK int
+
+	errorThreshold float64
+	minRequests    int
+	cooldown       time.Duration
+}
+
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		errorThreshold: envFloat("CIRCUIT_ERROR_THRESHOLD", 0.5),
+		minRequests:    envInt("CIRCUIT_MIN_REQUESTS", 10),
+		cooldown:       envDuration("CIRCUIT_COOLDOWN", 30*time.Second),
+	}
+}
+
+// allowRequest reports whether a request may proceed, flipping an open
+// breaker to half-open once its cooldown has elapsed.
+func (b *circuitBreaker) allowRequest() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerOpen {
+		return true
+	}
+	if time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.state = breakerHalfOpen
+	b.halfOpenOK = 0
+	return true
+}
+
+// recordResult feeds one request's outcome back into the breaker.
+func (b *circuitBreaker) recordResult(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	bucket := b.bucketFor(now)
+	bucket.total++
+	if !success {
+		bucket.failures++
+	}
+
+	switch b.state {
+	case breakerHalfOpen:
+		if !success {
+			b.state = breakerOpen
+			b.openedAt = now
+			return
+		}
+		b.halfOpenOK++
+		if b.halfOpenOK >= breakerHalfOpenProbes {
+			b.state = breakerClosed
+		}
+	case breakerClosed:
+		total, failures := b.windowCounts(now)
+		if total >= b.minRequests && float64(failures)/float64(total) >= b.errorThreshold {
+			b.state = breakerOpen
+			b.openedAt = now
+		}
+	}
+}
+
+func (b *circuitBreaker) bucketFor(now time.Time) *breakerBucket {
+	idx := now.Unix() % int64(len(b.buckets))
+	bucket := &b.buckets[idx]
+	if bucket.atUnix != now.Unix() {
+		*bucket = breakerBucket{atUnix: now.Unix()}
+	}
+	return bucket
+}
+
+func (b *circuitBreaker) windowCounts(now time.Time) (total, failures int) {
+	cutoff := now.Add(-breakerWindow).Unix()
+	for i := range b.buckets {
+		if b.buckets[i].atUnix > cutoff {
+			total += b.buckets[i].total
+			failures += b.buckets[i].failures
+		}
+	}
+	return total, failures
+}
+
+func (b *circuitBreaker) snapshot() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state.String()
+}
+
+// statusRecorder captures the status code a wrapped handler writes, so
+// middleware can see it without the handler reporting back explicitly.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through to the wrapped writer so streaming handlers like
+// handleStream still see an http.Flusher behind the middleware.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// withRateLimitAndBreaker wraps a handler with per-client token-bucket
+// rate limiting and the shared circuit breaker, so a burst of requests or
+// a run of Piper failures can't thrash the host's limited worker pools.
+// route labels the metrics this middleware records on its own short-circuit
+// paths (429/503) with the same route name the wrapped handler itself uses.
+//
+// The breaker's rec.status check still makes sense for a streaming handler
+// like handleStream: http.ResponseWriter.WriteHeader latches the first call,
+// so even though handleStream writes partial PCM after its 200 header, the
+// breaker only ever sees that first (and only) status code, the same as for
+// a buffered handler.
+func withRateLimitAndBreaker(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// While the engine is still warming up, the handler's own
+		// readiness gate returns 503 regardless of Piper's health; don't
+		// let that feed the breaker; it trips on Piper failures, not
+		// startup timing.
+		mu.Lock()
+		ready := isReady
+		mu.Unlock()
+
+		ip := clientIP(r)
+		allowed, retryAfter, _, err := limiter.allow(r.Context(), ip)
+		if err != nil {
+			log.Printf("Rate limiter error: %v", err)
+		} else if !allowed {
+			metrics.recordRequest(route, "429")
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds()+1)))
+			http.Error(w, "rate limit exceeded, try again shortly", http.StatusTooManyRequests)
+			return
+		}
+
+		if ready && !breaker.allowRequest() {
+			metrics.recordRequest(route, "503")
+			http.Error(w, "service temporarily unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		if ready {
+			breaker.recordResult(rec.status < http.StatusInternalServerError)
+		}
+	}
+}
+
+// rateLimitReport builds the "rate_limit" section of /service: the
+// limiter's config plus the calling client's own current token level, so
+// operators see actual back-pressure rather than just static config.
+func rateLimitReport(r *http.Request) map[string]interface{} {
+	info := limiter.describe()
+	if tokens, err := limiter.peek(r.Context(), clientIP(r)); err == nil {
+		info["tokens_remaining"] = tokens
+	}
+	return info
+}
+
+func envFloat(name string, fallback float64) float64 {
+	if v := os.Getenv(name); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f > 0 {
+			return f
+		}
+	}
+	return fallback
+}
+
+func envInt(name string, fallback int) int {
+	if v := os.Getenv(name); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return fallback
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if v := os.Getenv(name); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			return d
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRateLimiterAllowsUpToBurstThenBlocks(t *testing.T) {
+	l := newMemoryRateLimiter(1, 3)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		allowed, _, _, err := l.allow(ctx, "client-a")
+		if err != nil {
+			t.Fatalf("allow #%d: unexpected error: %v", i, err)
+		}
+		if !allowed {
+			t.Fatalf("allow #%d: want allowed, got blocked", i)
+		}
+	}
+
+	allowed, retryAfter, tokens, err := l.allow(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("allow after burst: unexpected error: %v", err)
+	}
+	if allowed {
+		t.Fatal("allow after burst exhausted: want blocked, got allowed")
+	}
+	if retryAfter <= 0 {
+		t.Errorf("retryAfter = %v, want positive", retryAfter)
+	}
+	if tokens >= 1 {
+		t.Errorf("tokens = %v, want < 1", tokens)
+	}
+}
+
+func TestMemoryRateLimiterTracksClientsIndependently(t *testing.T) {
+	l := newMemoryRateLimiter(1, 1)
+	ctx := context.Background()
+
+	if allowed, _, _, _ := l.allow(ctx, "client-a"); !allowed {
+		t.Fatal("client-a first request: want allowed")
+	}
+	if allowed, _, _, _ := l.allow(ctx, "client-a"); allowed {
+		t.Fatal("client-a second request: want blocked, burst is 1")
+	}
+	if allowed, _, _, _ := l.allow(ctx, "client-b"); !allowed {
+		t.Fatal("client-b first request: want allowed, separate bucket from client-a")
+	}
+}
+
+func TestMemoryRateLimiterPeekDoesNotConsume(t *testing.T) {
+	l := newMemoryRateLimiter(1, 2)
+	ctx := context.Background()
+
+	if tokens, err := l.peek(ctx, "client-a"); err != nil || tokens != 2 {
+		t.Fatalf("peek on unseen client = (%v, %v), want (2, nil)", tokens, err)
+	}
+
+	if _, _, _, err := l.allow(ctx, "client-a"); err != nil {
+		t.Fatalf("allow: unexpected error: %v", err)
+	}
+
+	tokens, err := l.peek(ctx, "client-a")
+	if err != nil {
+		t.Fatalf("peek: unexpected error: %v", err)
+	}
+	// One token was just spent out of a burst of 2, and peek must not
+	// spend another: tokens should read ~1, never back up near the full
+	// burst of 2.
+	if tokens < 0.9 || tokens > 1.1 {
+		t.Errorf("peek after spending one token = %v, want ~1", tokens)
+	}
+}
+
+func TestCircuitBreakerTripsOnErrorRateAndRecovers(t *testing.T) {
+	b := &circuitBreaker{errorThreshold: 0.5, minRequests: 4, cooldown: 10 * time.Millisecond}
+
+	if !b.allowRequest() {
+		t.Fatal("new breaker: want closed (allowing requests)")
+	}
+
+	b.recordResult(false)
+	b.recordResult(false)
+	b.recordResult(true)
+	b.recordResult(false)
+
+	if b.snapshot() != "open" {
+		t.Fatalf("breaker state = %q, want %q after crossing error threshold", b.snapshot(), "open")
+	}
+	if b.allowRequest() {
+		t.Fatal("open breaker: want requests blocked before cooldown elapses")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !b.allowRequest() {
+		t.Fatal("breaker after cooldown: want half-open (allowing a probe)")
+	}
+	if b.snapshot() != "half_open" {
+		t.Fatalf("breaker state = %q, want %q", b.snapshot(), "half_open")
+	}
+}
+
+func TestCircuitBreakerHalfOpenReopensOnFailure(t *testing.T) {
+	b := &circuitBreaker{errorThreshold: 0.5, minRequests: 1, cooldown: 10 * time.Millisecond}
+
+	b.recordResult(false)
+	if b.snapshot() != "open" {
+		t.Fatalf("breaker state = %q, want %q", b.snapshot(), "open")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	b.allowRequest() // transitions open -> half_open
+
+	b.recordResult(false)
+	if b.snapshot() != "open" {
+		t.Fatalf("breaker state after half-open failure = %q, want %q", b.snapshot(), "open")
+	}
+}
+
+func TestCircuitBreakerHalfOpenClosesAfterProbes(t *testing.T) {
+	b := &circuitBreaker{errorThreshold: 0.5, minRequests: 1, cooldown: 10 * time.Millisecond}
+
+	b.recordResult(false)
+	time.Sleep(20 * time.Millisecond)
+	b.allowRequest() // transitions open -> half_open
+
+	for i := 0; i < breakerHalfOpenProbes; i++ {
+		b.recordResult(true)
+	}
+	if b.snapshot() != "closed" {
+		t.Fatalf("breaker state after %d successful probes = %q, want %q", breakerHalfOpenProbes, b.snapshot(), "closed")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssmlSegment is one unit of an SSML document to render in order: either
+// text to synthesize (with any <prosody> overrides in effect) or a gap of
+// silence from a <break>.
+type ssmlSegment struct {
+	Text        string
+	LengthScale float64
+	NoiseScale  float64
+	SilenceMS   int
+}
+
+// prosodyScale is the length_scale/noise_scale pair a <prosody> element
+// contributes; zero fields mean "inherit from the enclosing prosody".
+type prosodyScale struct {
+	lengthScale float64
+	noiseScale  float64
+}
+
+// parseSSML parses the small subset of SSML this service supports --
+// <speak>, <s>, <break time="...">, <prosody rate="..." pitch="...">, and
+// <say-as interpret-as="..."> (accepted but synthesized as plain text) --
+// into a flat sequence of segments to render in document order.
+func parseSSML(doc string) ([]ssmlSegment, error) {
+	decoder := xml.NewDecoder(strings.NewReader(doc))
+
+	var segments []ssmlSegment
+	var textBuf strings.Builder
+	var prosodyStack []prosodyScale
+
+	flush := func() {
+		text := strings.TrimSpace(textBuf.String())
+		textBuf.Reset()
+		if text == "" {
+			return
+		}
+		seg := ssmlSegment{Text: text}
+		if len(prosodyStack) > 0 {
+			top := prosodyStack[len(prosodyStack)-1]
+			seg.LengthScale = top.lengthScale
+			seg.NoiseScale = top.noiseScale
+		}
+		segments = append(segments, seg)
+	}
+
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse ssml: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "s":
+				flush()
+			case "prosody":
+				flush()
+				scale := prosodyScale{}
+				if len(prosodyStack) > 0 {
+					scale = prosodyStack[len(prosodyStack)-1]
+				}
+				for _, attr := range t.Attr {
+					switch attr.Name.Local {
+					case "rate":
+						scale.lengthScale = rateToLengthScale(attr.Value)
+					case "pitch":
+						scale.noiseScale = pitchToNoiseScale(attr.Value)
+					}
+				}
+				prosodyStack = append(prosodyStack, scale)
+			case "break":
+				flush()
+				ms := 0
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "time" {
+						ms = parseBreakTime(attr.Value)
+					}
+				}
+				segments = append(segments, ssmlSegment{SilenceMS: ms})
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "s":
+				flush()
+			case "prosody":
+				flush()
+				if len(prosodyStack) > 0 {
+					prosodyStack = prosodyStack[:len(prosodyStack)-1]
+				}
+			}
+		case xml.CharData:
+			textBuf.Write(t)
+		}
+	}
+	flush()
+
+	return segments, nil
+}
+
+// rateToLengthScale maps an SSML <prosody rate="..."> value onto piper's
+// length_scale, which runs the opposite direction of "rate" (bigger
+// length_scale means slower speech).
+func rateToLengthScale(rate string) float64 {
+	switch strings.ToLower(strings.TrimSpace(rate)) {
+	case "x-slow":
+		return 1.6
+	case "slow":
+		return 1.3
+	case "medium", "":
+		return 1.0
+	case "fast":
+		return 0.8
+	case "x-fast":
+		return 0.6
+	}
+	if pct, ok := strings.CutSuffix(rate, "%"); ok {
+		if v, err := strconv.ParseFloat(pct, 64); err == nil && v > 0 {
+			return 100.0 / v
+		}
+	}
+	if v, err := strconv.ParseFloat(rate, 64); err == nil && v > 0 {
+		return 1.0 / v
+	}
+	return 1.0
+}
+
+// pitchToNoiseScale maps an SSML <prosody pitch="..."> value onto piper's
+// noise_scale. Piper's VITS models have no native pitch control, so this
+// is a rough proxy: higher noise_scale reads as more varied/"brighter"
+// delivery, which is the closest available knob to "higher pitch".
+func pitchToNoiseScale(pitch string) float64 {
+	switch strings.ToLower(strings.TrimSpace(pitch)) {
+	case "x-low":
+		return 0.3
+	case "low":
+		return 0.5
+	case "medium", "default", "":
+		return 0.667
+	case "high":
+		return 0.8
+	case "x-high":
+		return 0.9
+	}
+	return 0.667
+}
+
+// parseBreakTime parses an SSML <break time="..."> value ("500ms", "2s")
+// into milliseconds, defaulting to 0 (no gap) if it can't be parsed.
+func parseBreakTime(value string) int {
+	value = strings.TrimSpace(value)
+	if ms, ok := strings.CutSuffix(value, "ms"); ok {
+		if n, err := strconv.Atoi(strings.TrimSpace(ms)); err == nil {
+			return n
+		}
+		return 0
+	}
+	if s, ok := strings.CutSuffix(value, "s"); ok {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return int(n * 1000)
+		}
+	}
+	return 0
+}
+
+// silencePCM returns ms milliseconds of silent 16-bit mono PCM at
+// sampleRate, for rendering SSML <break> gaps between segments.
+func silencePCM(ms, sampleRate int) []byte {
+	if ms <= 0 || sampleRate <= 0 {
+		return nil
+	}
+	samples := sampleRate * ms / 1000
+	return make([]byte, samples*2) // 16-bit mono, zero-valued == silence
+}
+
+// segmentCacheKey is the Redis key for one SSML segment's synthesized
+// PCM, keyed on voice, text, and prosody so edits to one part of a long
+// document don't invalidate the rest.
+func segmentCacheKey(voiceID string, seg ssmlSegment) string {
+	hash := md5.Sum([]byte(fmt.Sprintf("%s\x00%s\x00%g\x00%g", voiceID, seg.Text, seg.LengthScale, seg.NoiseScale)))
+	return "tts:cache:segment:" + hex.EncodeToString(hash[:])
+}
+
+// synthesizeSSML parses doc and renders it to raw PCM, synthesizing each
+// text segment through the voice's worker pool (reusing any cached
+// segment already in Redis) and inserting silence for each <break>.
+func synthesizeSSML(ctx context.Context, voiceID string, p *workerPool, sampleRate int, doc string) ([]byte, error) {
+	segments, err := parseSSML(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var pcm []byte
+	for _, seg := range segments {
+		if seg.Text == "" {
+			pcm = append(pcm, silencePCM(seg.SilenceMS, sampleRate)...)
+			continue
+		}
+
+		segKey := segmentCacheKey(voiceID, seg)
+		if redisClient != nil {
+			if val, err := redisClient.Get(ctx, segKey).Bytes(); err == nil {
+				pcm = append(pcm, val...)
+				continue
+			}
+		}
+
+		segPCM, err := p.submit(synthParams{Text: seg.Text, LengthScale: seg.LengthScale, NoiseScale: seg.NoiseScale})
+		if err != nil {
+			return nil, fmt.Errorf("synthesize ssml segment: %w", err)
+		}
+
+		if redisClient != nil {
+			redisClient.Set(ctx, segKey, segPCM, 48*time.Hour)
+		}
+		pcm = append(pcm, segPCM...)
+	}
+
+	return pcm, nil
+}
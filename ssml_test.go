@@ -0,0 +1,96 @@
+package main
+
+import "testing"
+
+func TestParseSSMLSentencesAndBreaks(t *testing.T) {
+	doc := `<speak><s>Hello there.</s><break time="500ms"/><s>Goodbye.</s></speak>`
+
+	segments, err := parseSSML(doc)
+	if err != nil {
+		t.Fatalf("parseSSML: %v", err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("got %d segments, want 3: %+v", len(segments), segments)
+	}
+	if segments[0].Text != "Hello there." {
+		t.Errorf("segment 0 text = %q, want %q", segments[0].Text, "Hello there.")
+	}
+	if segments[1].Text != "" || segments[1].SilenceMS != 500 {
+		t.Errorf("segment 1 = %+v, want a 500ms silence", segments[1])
+	}
+	if segments[2].Text != "Goodbye." {
+		t.Errorf("segment 2 text = %q, want %q", segments[2].Text, "Goodbye.")
+	}
+}
+
+func TestParseSSMLProsodyAppliesToEnclosedText(t *testing.T) {
+	doc := `<speak><prosody rate="slow" pitch="high">Slow and high.</prosody>Back to normal.</speak>`
+
+	segments, err := parseSSML(doc)
+	if err != nil {
+		t.Fatalf("parseSSML: %v", err)
+	}
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2: %+v", len(segments), segments)
+	}
+
+	want := rateToLengthScale("slow")
+	if segments[0].LengthScale != want {
+		t.Errorf("prosody segment LengthScale = %v, want %v", segments[0].LengthScale, want)
+	}
+	if segments[1].LengthScale != 0 {
+		t.Errorf("segment after </prosody> LengthScale = %v, want 0 (no override)", segments[1].LengthScale)
+	}
+}
+
+func TestParseSSMLRejectsMalformedXML(t *testing.T) {
+	// Unterminated attribute value is a genuine XML syntax error: the
+	// quoted value swallows the rest of the document.
+	if _, err := parseSSML(`<speak><prosody rate="slow>broken</prosody></speak>`); err == nil {
+		t.Fatal("parseSSML with malformed attribute: want error, got nil")
+	}
+}
+
+func TestRateToLengthScale(t *testing.T) {
+	cases := map[string]float64{
+		"":       1.0,
+		"medium": 1.0,
+		"slow":   1.3,
+		"fast":   0.8,
+		"200%":   0.5,
+		"0.5":    2.0,
+		"bogus":  1.0,
+	}
+	for rate, want := range cases {
+		if got := rateToLengthScale(rate); got != want {
+			t.Errorf("rateToLengthScale(%q) = %v, want %v", rate, got, want)
+		}
+	}
+}
+
+func TestParseBreakTime(t *testing.T) {
+	cases := map[string]int{
+		"500ms": 500,
+		"2s":    2000,
+		"1.5s":  1500,
+		"":      0,
+		"bogus": 0,
+	}
+	for value, want := range cases {
+		if got := parseBreakTime(value); got != want {
+			t.Errorf("parseBreakTime(%q) = %d, want %d", value, got, want)
+		}
+	}
+}
+
+func TestSilencePCMLength(t *testing.T) {
+	got := silencePCM(1000, 22050)
+	want := 22050 * 2 // 16-bit mono samples for one second
+	if len(got) != want {
+		t.Errorf("silencePCM(1000, 22050) length = %d, want %d", len(got), want)
+	}
+
+	if got := silencePCM(0, 22050); got != nil {
+		t.Errorf("silencePCM(0, ...) = %v, want nil", got)
+	}
+}
@@ -1,12 +1,5 @@
 package utils
 
-import (
-	"os"
-	"os/exec"
-	"strconv"
-	"strings"
-)
-
 // SystemMetrics holds CPU and Memory usage statistics
 type SystemMetrics struct {
 	CPU    MetricValue `json:"cpu"`
@@ -18,40 +11,15 @@ type MetricValue struct {
 	Avg float64 `json:"avg"`
 }
 
-// GetMetrics returns current CPU and Memory usage metrics for the current process
-// and any optional additional PIDs (like child processes).
-func GetMetrics(pids ...int) SystemMetrics {
-	totalCPU, totalMem := getPIDStats(os.Getpid())
-
-	for _, pid := range pids {
-		if pid <= 0 {
-			continue
-		}
-		cpu, mem := getPIDStats(pid)
-		totalCPU += cpu
-		totalMem += mem
-	}
-
+// GetProcessMetrics returns CPU/Memory stats for exactly one pid, so
+// callers needing a gauge per process (the main process, plus one per
+// live piper worker) get a clean, unmerged reading for each. getPIDStats
+// is platform-specific: Linux reads /proc directly, Darwin and the BSDs
+// shell out to `ps`.
+func GetProcessMetrics(pid int) SystemMetrics {
+	cpu, memMB := getPIDStats(pid)
 	return SystemMetrics{
-		CPU:    MetricValue{Avg: totalCPU},
-		Memory: MetricValue{Avg: totalMem},
-	}
-}
-
-func getPIDStats(pid int) (cpu float64, memMB float64) {
-	// Use 'ps' to get CPU percentage and RSS (Resident Set Size) in KB
-	cmd := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "%cpu,rss", "--no-headers")
-	output, err := cmd.Output()
-	if err != nil {
-		return 0, 0
+		CPU:    MetricValue{Avg: cpu},
+		Memory: MetricValue{Avg: memMB},
 	}
-
-	fields := strings.Fields(string(output))
-	if len(fields) >= 2 {
-		cpu, _ = strconv.ParseFloat(fields[0], 64)
-		memKB, _ := strconv.ParseFloat(fields[1], 64)
-		memMB = memKB / 1024.0
-	}
-
-	return cpu, memMB
 }
@@ -0,0 +1,32 @@
+//go:build darwin || freebsd || netbsd || openbsd
+
+package utils
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// getPIDStats shells out to `ps` on platforms without a /proc filesystem.
+// Unlike the Linux implementation, CPU% here is ps's own lifetime average
+// for the process rather than a delta over the scrape interval.
+func getPIDStats(pid int) (cpu float64, memMB float64) {
+	// BSD/Darwin ps has no GNU --no-headers; suppress each column's header
+	// instead by naming it with a trailing "=", which BSD ps treats as an
+	// empty header string.
+	cmd := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "%cpu=,rss=")
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, 0
+	}
+
+	fields := strings.Fields(string(output))
+	if len(fields) >= 2 {
+		cpu, _ = strconv.ParseFloat(fields[0], 64)
+		memKB, _ := strconv.ParseFloat(fields[1], 64)
+		memMB = memKB / 1024.0
+	}
+
+	return cpu, memMB
+}
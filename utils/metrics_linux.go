@@ -0,0 +1,120 @@
+//go:build linux
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clockTicksPerSecond is USER_HZ, the unit /proc/<pid>/stat reports
+// utime/stime in. It has stayed 100 on effectively every mainstream
+// Linux distro regardless of kernel CONFIG_HZ, so it's safe to hardcode
+// rather than pull in a cgo/syscall dependency just for sysconf(_SC_CLK_TCK).
+const clockTicksPerSecond = 100
+
+type cpuSample struct {
+	totalTicks uint64
+	at         time.Time
+}
+
+var (
+	cpuSamplesMu sync.Mutex
+	cpuSamples   = make(map[int]cpuSample)
+)
+
+// getPIDStats reads /proc/<pid>/stat and /proc/<pid>/status directly so
+// metrics collection works in minimal containers without a `ps` binary.
+// CPU% is the delta in process CPU ticks between successive calls for the
+// same pid divided by wall-clock elapsed time, so a scrape reflects
+// recent load rather than the process's lifetime average.
+func getPIDStats(pid int) (cpuPercent, memMB float64) {
+	ticks, err := readProcTicks(pid)
+	if err != nil {
+		return 0, 0
+	}
+	memMB, err = readProcRSSMB(pid)
+	if err != nil {
+		return 0, 0
+	}
+
+	now := time.Now()
+	cpuSamplesMu.Lock()
+	prev, ok := cpuSamples[pid]
+	cpuSamples[pid] = cpuSample{totalTicks: ticks, at: now}
+	cpuSamplesMu.Unlock()
+
+	if !ok {
+		return 0, memMB
+	}
+
+	elapsed := now.Sub(prev.at).Seconds()
+	if elapsed <= 0 || ticks < prev.totalTicks {
+		return 0, memMB
+	}
+
+	cpuPercent = float64(ticks-prev.totalTicks) / clockTicksPerSecond / elapsed * 100
+	return cpuPercent, memMB
+}
+
+func readProcTicks(pid int) (uint64, error) {
+	raw, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// comm (field 2) is parenthesized and may itself contain spaces or
+	// parens, so split on the last ')' rather than whitespace.
+	paren := strings.LastIndex(string(raw), ")")
+	if paren == -1 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat format", pid)
+	}
+
+	fields := strings.Fields(string(raw)[paren+1:])
+	// fields[0] is state (field 3 overall), so utime (field 14) is
+	// fields[11] and stime (field 15) is fields[12].
+	if len(fields) < 13 {
+		return 0, fmt.Errorf("unexpected /proc/%d/stat field count", pid)
+	}
+
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return utime + stime, nil
+}
+
+func readProcRSSMB(pid int) (float64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return 0, fmt.Errorf("unexpected VmRSS format for pid %d", pid)
+		}
+		kb, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb / 1024.0, nil
+	}
+	return 0, fmt.Errorf("VmRSS not found for pid %d", pid)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxDownloadAttempts bounds the exponential-backoff retry loop in
+// downloadVerified; a release that fails checksum this many times in a
+// row is treated as a supply-chain problem, not a transient blip.
+const maxDownloadAttempts = 4
+
+// downloadVerified downloads url to dest, retrying with exponential
+// backoff on network failure or checksum mismatch. It fails closed: any
+// partially or incorrectly downloaded file is deleted before retrying so
+// a caller never ends up executing or loading a corrupt asset.
+// expectedSHA256 and sigURL may be empty to skip either check, unless
+// TTS_REQUIRE_CHECKSUMS=1 is set, in which case an empty expectedSHA256
+// is itself a failure rather than a silent skip -- see requireChecksums.
+//
+// The download itself lands in a sibling temp file that's only renamed
+// onto dest after every check passes. This matters when two callers race
+// to populate the same dest (e.g. two concurrent voice installs): without
+// it, one caller's in-progress write or failed-checksum cleanup could
+// corrupt or delete a file the other caller already verified good.
+func downloadVerified(url, dest, expectedSHA256, sigURL string) error {
+	if expectedSHA256 == "" {
+		if requireChecksums() {
+			return fmt.Errorf("no SHA256 pinned for %s and TTS_REQUIRE_CHECKSUMS=1: refusing to download unverified", url)
+		}
+		log.Printf("WARNING: downloading %s with no SHA256 pinned -- checksum verification is disabled for this asset", url)
+	}
+
+	destDir := filepath.Dir(dest)
+	var lastErr error
+	for attempt := 0; attempt < maxDownloadAttempts; attempt++ {
+		if attempt > 0 {
+			backoff := time.Duration(1<<uint(attempt)) * time.Second
+			log.Printf("Retrying download of %s in %s (attempt %d/%d): %v", url, backoff, attempt+1, maxDownloadAttempts, lastErr)
+			time.Sleep(backoff)
+		}
+
+		tmp, err := os.CreateTemp(destDir, filepath.Base(dest)+".tmp-*")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		tmpPath := tmp.Name()
+		_ = tmp.Close()
+
+		if err := downloadFile(url, tmpPath); err != nil {
+			_ = os.Remove(tmpPath)
+			lastErr = err
+			continue
+		}
+
+		if expectedSHA256 != "" {
+			if err := verifyChecksum(tmpPath, expectedSHA256); err != nil {
+				_ = os.Remove(tmpPath)
+				lastErr = err
+				continue
+			}
+		}
+
+		if err := verifySignature(tmpPath, sigURL); err != nil {
+			_ = os.Remove(tmpPath)
+			lastErr = err
+			continue
+		}
+
+		if err := os.Rename(tmpPath, dest); err != nil {
+			_ = os.Remove(tmpPath)
+			lastErr = err
+			continue
+		}
+
+		return nil
+	}
+	return fmt.Errorf("download %s failed after %d attempts: %w", url, maxDownloadAttempts, lastErr)
+}
+
+// requireChecksums reports whether TTS_REQUIRE_CHECKSUMS is set to "1",
+// turning a missing expectedSHA256 in downloadVerified from a logged
+// warning into a hard failure. Off by default so a deploy without any
+// pinned hashes yet can still start; production deploys that have pinned
+// real hashes in their voice catalog and TTS_PIPER_SHA256 should set this
+// so a future catalog edit that drops a hash fails loudly instead of
+// silently disabling verification for that asset.
+func requireChecksums() bool {
+	return os.Getenv("TTS_REQUIRE_CHECKSUMS") == "1"
+}
+
+func verifyChecksum(path, expectedSHA256 string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != expectedSHA256 {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", path, got, expectedSHA256)
+	}
+	return nil
+}
+
+// verifySignature checks a minisign signature for path against
+// TTS_ASSET_PUBKEY, fetching it from sigURL. Most voice/piper releases
+// don't publish one today, so this is a no-op unless both the public key
+// and a signature URL are available.
+func verifySignature(path, sigURL string) error {
+	pubKey := os.Getenv("TTS_ASSET_PUBKEY")
+	if pubKey == "" || sigURL == "" {
+		return nil
+	}
+
+	sigPath := path + ".minisig"
+	if err := downloadFile(sigURL, sigPath); err != nil {
+		return fmt.Errorf("download signature: %w", err)
+	}
+	defer func() { _ = os.Remove(sigPath) }()
+
+	cmd := exec.Command("minisign", "-V", "-p", pubKey, "-m", path, "-x", sigPath)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("signature verification failed: %s: %w", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyChecksumMatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "asset.bin")
+	content := []byte("piper release asset contents")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("write test file: %v", err)
+	}
+
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+
+	if err := verifyChecksum(path, want); err != nil {
+		t.Fatalf("verifyChecksum with correct digest: %v", err)
+	}
+}
+
+func TestVerifyChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "asset.bin")
+	if err := os.WriteFile(path, []byte("corrupted or tampered bytes"), 0644); err != nil {
+		t.Fatalf("write test file: %v", err)
+	}
+
+	err := verifyChecksum(path, "0000000000000000000000000000000000000000000000000000000000000")
+	if err == nil {
+		t.Fatal("verifyChecksum with wrong digest returned nil error, want mismatch")
+	}
+}
+
+// TestDownloadVerifiedDoesNotTouchDestOnChecksumMismatch is the regression
+// test for the install race the reviewer flagged: a failing download must
+// never remove or overwrite a file that's already sitting at dest, since a
+// concurrent caller may have just placed a good one there.
+func TestDownloadVerifiedDoesNotTouchDestOnChecksumMismatch(t *testing.T) {
+	content := []byte("the real asset bytes")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "voice.onnx")
+	existing := []byte("a good file already installed by another request")
+	if err := os.WriteFile(dest, existing, 0644); err != nil {
+		t.Fatalf("seed existing dest: %v", err)
+	}
+
+	err := downloadVerified(srv.URL, dest, "0000000000000000000000000000000000000000000000000000000000000", "")
+	if err == nil {
+		t.Fatal("downloadVerified with wrong digest: want error, got nil")
+	}
+
+	got, readErr := os.ReadFile(dest)
+	if readErr != nil {
+		t.Fatalf("read dest after failed download: %v", readErr)
+	}
+	if string(got) != string(existing) {
+		t.Errorf("dest contents = %q after failed download, want untouched %q", got, existing)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir has %d entries after failed download, want 1 (no leftover temp file): %+v", len(entries), entries)
+	}
+}
+
+func TestDownloadVerifiedWritesDestOnlyAfterChecksumPasses(t *testing.T) {
+	content := []byte("the real asset bytes")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(content)
+	want := hex.EncodeToString(sum[:])
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "voice.onnx")
+
+	if err := downloadVerified(srv.URL, dest, want, ""); err != nil {
+		t.Fatalf("downloadVerified with correct digest: %v", err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("read dest: %v", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("dest contents = %q, want %q", got, content)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("dir has %d entries after successful download, want 1 (no leftover temp file): %+v", len(entries), entries)
+	}
+}
+
+func TestDownloadVerifiedRequireChecksumsRejectsEmptyDigest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("asset bytes"))
+	}))
+	defer srv.Close()
+
+	t.Setenv("TTS_REQUIRE_CHECKSUMS", "1")
+
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "voice.onnx")
+
+	if err := downloadVerified(srv.URL, dest, "", ""); err == nil {
+		t.Fatal("downloadVerified with empty digest and TTS_REQUIRE_CHECKSUMS=1: want error, got nil")
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Error("downloadVerified should not have written dest when refusing an unverified asset")
+	}
+}
+
+func TestSafeJoinRejectsTraversal(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []string{
+		"../../etc/cron.d/evil",
+		"../escape.txt",
+		"a/../../b",
+	}
+	for _, name := range cases {
+		if _, err := safeJoin(dir, name); err == nil {
+			t.Errorf("safeJoin(%q, %q): want error, got nil", dir, name)
+		}
+	}
+}
+
+func TestSafeJoinAllowsNestedPaths(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []string{
+		"model.onnx",
+		"nested/model.onnx",
+		"./model.onnx",
+	}
+	for _, name := range cases {
+		target, err := safeJoin(dir, name)
+		if err != nil {
+			t.Errorf("safeJoin(%q, %q): unexpected error: %v", dir, name, err)
+			continue
+		}
+		if !filepath.IsAbs(target) {
+			t.Errorf("safeJoin(%q, %q) = %q, want absolute path", dir, name, target)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultVoiceID is used when a GenerateRequest omits Voice.
+const defaultVoiceID = "en_GB-northern_english_male-medium"
+
+// embeddedVoiceCatalog's sha256/config_sha256 fields are left empty, same
+// rationale as defaultPiperSHA256 in main.go: downloadVerified logs a
+// warning (or, with TTS_REQUIRE_CHECKSUMS=1, fails closed) for an empty
+// digest rather than silently trusting it, and a fabricated value would
+// guarantee VoiceRegistry.install fails on every fresh deploy. Fill them
+// in with `curl -sL <url> | sha256sum` against each model_url/config_url
+// once that's been computed somewhere with network access -- or, without
+// touching this embedded copy, point TTS_VOICES_FILE at an operator-
+// maintained catalog with the real hashes already pinned.
+//
+//go:embed voices.json
+var embeddedVoiceCatalog []byte
+
+// VoiceInfo describes one entry in the voice catalog.
+type VoiceInfo struct {
+	ID           string `json:"id"`
+	Language     string `json:"language"`
+	Quality      string `json:"quality"`
+	ModelURL     string `json:"model_url"`
+	ConfigURL    string `json:"config_url"`
+	SHA256       string `json:"sha256,omitempty"`
+	ConfigSHA256 string `json:"config_sha256,omitempty"`
+}
+
+// voiceListEntry is what GET /voices returns for each catalog entry.
+type voiceListEntry struct {
+	VoiceInfo
+	Installed bool `json:"installed"`
+}
+
+// VoiceRegistry tracks the voice catalog, which voices are installed on
+// disk, and the worker pool backing each installed voice.
+type VoiceRegistry struct {
+	binDir    string
+	piperBin  string
+	modelsDir string
+	catalog   map[string]VoiceInfo
+
+	mu    sync.Mutex
+	pools map[string]*workerPool
+
+	installMu sync.Mutex
+	installs  map[string]*sync.Mutex
+}
+
+// loadVoiceCatalog reads the embedded voices.json, or the file at
+// TTS_VOICES_FILE when set.
+func loadVoiceCatalog() ([]VoiceInfo, error) {
+	data := embeddedVoiceCatalog
+	if path := os.Getenv("TTS_VOICES_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read TTS_VOICES_FILE: %w", err)
+		}
+		data = b
+	}
+
+	var voices []VoiceInfo
+	if err := json.Unmarshal(data, &voices); err != nil {
+		return nil, fmt.Errorf("parse voice catalog: %w", err)
+	}
+	return voices, nil
+}
+
+// defaultVoiceIDs lists the voices ensureAssets should preload at
+// startup; override with a comma-separated TTS_DEFAULT_VOICES.
+func defaultVoiceIDs() []string {
+	if v := os.Getenv("TTS_DEFAULT_VOICES"); v != "" {
+		var ids []string
+		for _, id := range strings.Split(v, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			return ids
+		}
+	}
+	return []string{defaultVoiceID}
+}
+
+func newVoiceRegistry(binDir, piperBin, modelsDir string, catalog []VoiceInfo) *VoiceRegistry {
+	byID := make(map[string]VoiceInfo, len(catalog))
+	for _, v := range catalog {
+		byID[v.ID] = v
+	}
+	return &VoiceRegistry{
+		binDir:    binDir,
+		piperBin:  piperBin,
+		modelsDir: modelsDir,
+		catalog:   byID,
+		pools:     make(map[string]*workerPool),
+		installs:  make(map[string]*sync.Mutex),
+	}
+}
+
+func (vr *VoiceRegistry) modelPath(id string) string {
+	return filepath.Join(vr.modelsDir, id+".onnx")
+}
+
+func (vr *VoiceRegistry) configPath(id string) string {
+	return filepath.Join(vr.modelsDir, id+".onnx.json")
+}
+
+// piperVoiceConfig is the subset of a voice's <id>.onnx.json this service
+// reads; piper itself consumes the rest.
+type piperVoiceConfig struct {
+	Audio struct {
+		SampleRate int `json:"sample_rate"`
+	} `json:"audio"`
+}
+
+// sampleRate reads the installed voice's sample rate from its onnx.json,
+// falling back to defaultSampleRate if the config is missing the field.
+func (vr *VoiceRegistry) sampleRate(id string) (int, error) {
+	data, err := os.ReadFile(vr.configPath(id))
+	if err != nil {
+		return 0, fmt.Errorf("read voice %s config: %w", id, err)
+	}
+	var cfg piperVoiceConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return 0, fmt.Errorf("parse voice %s config: %w", id, err)
+	}
+	if cfg.Audio.SampleRate <= 0 {
+		return defaultSampleRate, nil
+	}
+	return cfg.Audio.SampleRate, nil
+}
+
+func (vr *VoiceRegistry) isInstalled(id string) bool {
+	if _, err := os.Stat(vr.modelPath(id)); err != nil {
+		return false
+	}
+	_, err := os.Stat(vr.configPath(id))
+	return err == nil
+}
+
+// install downloads the voice's model and config if they aren't already
+// on disk. It is a no-op for a voice that's already installed.
+//
+// Concurrent POST /voices/{id}/install calls for the same id are
+// serialized per-voice so only one of them actually downloads: without
+// this, two overlapping installs could both think the voice isn't
+// installed yet and race to populate the same destination files.
+func (vr *VoiceRegistry) install(id string) error {
+	info, ok := vr.catalog[id]
+	if !ok {
+		return fmt.Errorf("unknown voice %q", id)
+	}
+
+	installLock := vr.installLock(id)
+	installLock.Lock()
+	defer installLock.Unlock()
+
+	if vr.isInstalled(id) {
+		return nil
+	}
+
+	_ = os.MkdirAll(vr.modelsDir, 0755)
+	if err := downloadVerified(info.ModelURL, vr.modelPath(id), info.SHA256, ""); err != nil {
+		return fmt.Errorf("download voice %s model: %w", id, err)
+	}
+	if err := downloadVerified(info.ConfigURL, vr.configPath(id), info.ConfigSHA256, ""); err != nil {
+		return fmt.Errorf("download voice %s config: %w", id, err)
+	}
+	return nil
+}
+
+// installLock returns the per-voice-id mutex that serializes install,
+// creating it on first use.
+func (vr *VoiceRegistry) installLock(id string) *sync.Mutex {
+	vr.installMu.Lock()
+	defer vr.installMu.Unlock()
+
+	l, ok := vr.installs[id]
+	if !ok {
+		l = &sync.Mutex{}
+		vr.installs[id] = l
+	}
+	return l
+}
+
+// pool returns the worker pool for an installed voice, starting it on
+// first use.
+func (vr *VoiceRegistry) pool(id string) (*workerPool, error) {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	if p, ok := vr.pools[id]; ok {
+		return p, nil
+	}
+	if !vr.isInstalled(id) {
+		return nil, fmt.Errorf("voice %q is not installed, POST /voices/%s/install first", id, id)
+	}
+
+	p, err := newWorkerPool(id, vr.piperBin, vr.modelPath(id), ttsWorkerCount())
+	if err != nil {
+		return nil, err
+	}
+	vr.pools[id] = p
+	return p, nil
+}
+
+// activePools returns a snapshot of every voice's worker pool that has
+// been started so far (at startup for the default voices, otherwise on
+// first /generate or /stream for it).
+func (vr *VoiceRegistry) activePools() map[string]*workerPool {
+	vr.mu.Lock()
+	defer vr.mu.Unlock()
+
+	snapshot := make(map[string]*workerPool, len(vr.pools))
+	for id, p := range vr.pools {
+		snapshot[id] = p
+	}
+	return snapshot
+}
+
+// workerPIDs lists the piper process id of every live worker across all
+// active voice pools, for per-process metrics gauges.
+func (vr *VoiceRegistry) workerPIDs() []int {
+	var pids []int
+	for _, p := range vr.activePools() {
+		pids = append(pids, p.pids()...)
+	}
+	return pids
+}
+
+func (vr *VoiceRegistry) list() []voiceListEntry {
+	ids := make([]string, 0, len(vr.catalog))
+	for id := range vr.catalog {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	entries := make([]voiceListEntry, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, voiceListEntry{
+			VoiceInfo: vr.catalog[id],
+			Installed: vr.isInstalled(id),
+		})
+	}
+	return entries
+}